@@ -0,0 +1,23 @@
+package ldap
+
+import ber "github.com/nmcclain/asn1-ber"
+
+// encodeBindResponseWithSasl is encodeBindResponse plus the optional
+// serverSaslCreds [7] OCTET STRING RFC 4511 §4.2 adds to BindResponse for
+// SASL binds. serverSaslCreds may be nil when the mechanism has nothing to
+// send back.
+func encodeBindResponseWithSasl(messageID uint64, ldapResultCode int, serverSaslCreds []byte) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+
+	bindResponse := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationBindResponse, nil, "Bind Response")
+	bindResponse.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldapResultCode), "Result Code"))
+	bindResponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	bindResponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, LDAPResultCodeMap[ldapResultCode], "Error Message"))
+	if serverSaslCreds != nil {
+		bindResponse.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, string(serverSaslCreds), "Server SASL Credentials"))
+	}
+	packet.AppendChild(bindResponse)
+
+	return packet
+}
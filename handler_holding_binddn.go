@@ -1,21 +1,110 @@
 package ldap
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
 	"io"
-	"log"
 	"net"
+	"sync"
 
-	"github.com/egxp/ldap/ldaplib"
 	ber "github.com/nmcclain/asn1-ber"
 )
 
 func (server *Server) handleConnectionAndSendBindDn(conn net.Conn) {
+	if server.OnNewConnection != nil {
+		if err := server.OnNewConnection(conn); err != nil {
+			server.logger().Warnf("remote=%s OnNewConnection rejected: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			return
+		}
+	}
+
 	boundDN := "" // "" == anonymous
+	var userState UserState
+	isTLS := false
+	hasNonAnonymousBind := false
+
+	// saslMechanism/saslState track a SASL bind across its round trips: a
+	// mechanism that returns Complete: false expects the next BindRequest
+	// to carry on the same negotiation.
+	saslMechanism := ""
+	var saslState interface{}
 
 	// Bind dn の bind request が送信済みか否かを表す真理値
 	isSentBindDn := false
 
+	// requestList tracks every in-flight operation by messageID so that an
+	// AbandonRequest handled below can reach in and cancel the matching
+	// worker's context. It's guarded by requestListMu since workers and the reader
+	// loop both touch it.
+	requestList := make(map[uint64]*Message)
+	var requestListMu sync.Mutex
+	var workers sync.WaitGroup
+
+	// chanOut serializes writes to conn: worker goroutines hand their
+	// response packet to the writer goroutine startWriter spawns below
+	// instead of calling sendPacket directly, so two operations finishing
+	// at the same time can never interleave their bytes on the wire.
+	// startWriter is also re-run after StartTLS swaps conn out from under
+	// it (see below), so it's a closure rather than a one-shot block.
+	var chanOut chan *ber.Packet
+	var writerDone chan struct{}
+	startWriter := func() {
+		chanOut = make(chan *ber.Packet, 16)
+		writerDone = make(chan struct{})
+		go func() {
+			defer close(writerDone)
+			for packet := range chanOut {
+				if err := sendPacket(conn, packet); err != nil {
+					server.logger().Errorf("remote=%s sendPacket error: %s", conn.RemoteAddr(), err.Error())
+				}
+			}
+		}()
+	}
+	startWriter()
+
+	// startWorker registers a cancellable Message for messageID and runs fn
+	// in its own goroutine, removing the Message from requestList when fn
+	// returns.
+	startWorker := func(messageID uint64, packet *ber.Packet, controls []Control, fn func(ctx context.Context)) {
+		ctx, cancel := context.WithCancel(context.Background())
+		message := &Message{MessageID: messageID, Packet: packet, Controls: controls, Ctx: ctx, Cancel: cancel}
+		requestListMu.Lock()
+		requestList[messageID] = message
+		requestListMu.Unlock()
+
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			defer cancel()
+			defer func() {
+				requestListMu.Lock()
+				delete(requestList, messageID)
+				requestListMu.Unlock()
+			}()
+			fn(ctx)
+		}()
+	}
+
+	// maybeProxyBind runs ProxyBind's admin rebind after a bind that
+	// completed successfully, when shouldProxyBind says the policy calls
+	// for it (always under ProxyAlways, only for an anonymous client under
+	// ProxyOnAnonymous), stashing the client's own identity in ProxyState.ClientDN before
+	// overwriting boundDN/userState with the proxy identity. It reports
+	// whether the connection should keep going.
+	maybeProxyBind := func() bool {
+		if !shouldProxyBind(server.ProxyBind.Policy, boundDN == "") {
+			return true
+		}
+		clientDN := boundDN
+		if !server.sendBindDnRequest(conn, chanOut, &boundDN, userState) {
+			return false
+		}
+		userState = ProxyState{ClientDN: clientDN, Prior: userState}
+		isSentBindDn = true
+		return true
+	}
+
 handler:
 	for {
 		// read incoming LDAP packet
@@ -23,24 +112,30 @@ handler:
 		if err == io.EOF { // Client closed connection
 			break
 		} else if err != nil {
-			log.Printf("handleConnection ber.ReadPacket ERROR: %s", err.Error())
+			server.logger().Errorf("remote=%s ber.ReadPacket error: %s", conn.RemoteAddr(), err.Error())
 			break
 		}
 
 		// sanity check this packet
 		if len(packet.Children) < 2 {
-			log.Print("len(packet.Children) < 2")
+			if server.Debug {
+				server.logger().Debugf("remote=%s malformed packet: len(packet.Children) < 2", conn.RemoteAddr())
+			}
 			break
 		}
 		// check the message ID and ClassType
 		messageID, ok := packet.Children[0].Value.(uint64)
 		if !ok {
-			log.Print("malformed messageID")
+			if server.Debug {
+				server.logger().Debugf("remote=%s malformed messageID", conn.RemoteAddr())
+			}
 			break
 		}
 		req := packet.Children[1]
 		if req.ClassType != ber.ClassApplication {
-			log.Print("req.ClassType != ber.ClassApplication")
+			if server.Debug {
+				server.logger().Debugf("remote=%s msgID=%d req.ClassType != ber.ClassApplication", conn.RemoteAddr(), messageID)
+			}
 			break
 		}
 		// handle controls if present
@@ -54,141 +149,250 @@ handler:
 		//log.Printf("DEBUG: handling operation: %s [%d]", ApplicationMap[req.Tag], req.Tag)
 		//ber.PrintPacket(packet) // DEBUG
 
-		// dispatch the LDAP operation
+		// dispatch the LDAP operation. Bind/Unbind/Abandon and StartTLS are
+		// handled inline because they affect the state of this loop directly
+		// (boundDN, conn, or whether to keep reading at all); every other
+		// operation runs in its own worker goroutine so a long-running
+		// request (chiefly search) can't block an Abandon arriving behind
+		// it.
 		switch req.Tag { // ldap op code
 		default:
 			responsePacket := encodeLDAPResponse(messageID, ApplicationAddResponse, LDAPResultOperationsError, "Unsupported operation: add")
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
-			}
-			log.Printf("Unhandled operation: %s [%d]", ApplicationMap[req.Tag], req.Tag)
+			chanOut <- responsePacket
+			server.logger().Warnf("remote=%s msgID=%d unhandled operation: %s [%d]", conn.RemoteAddr(), messageID, ApplicationMap[req.Tag], req.Tag)
 			break handler
 
 		case ApplicationBindRequest:
 			server.Stats.countBinds(1)
-			ldapResultCode := HandleBindRequest(req, server.BindFns, conn)
-			if ldapResultCode == LDAPResultSuccess {
-				boundDN, ok = req.Children[1].Value.(string)
-				if !ok {
-					log.Printf("Malformed Bind DN")
-					break handler
-				}
-			}
-			responsePacket := encodeBindResponse(messageID, ldapResultCode)
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
+
+			if len(req.Children) < 3 {
+				server.logger().Warnf("remote=%s msgID=%d malformed BindRequest: len(req.Children) < 3", conn.RemoteAddr(), messageID)
 				break handler
 			}
 
-			// Bind dn が空文字のとき、設定ファイルから bind dn を作成して bind request を送る
-			bindDnIsEmpty := false
-			judgeBindDnIsEmpty(packet, &bindDnIsEmpty)
-			if bindDnIsEmpty {
-				ok = server.sendBindDnRequest(conn, &boundDN)
+			if auth := req.Children[2]; auth.Tag == 3 { // SaslCredentials
+				if len(auth.Children) == 0 {
+					server.logger().Warnf("remote=%s msgID=%d malformed SaslCredentials: no mechanism", conn.RemoteAddr(), messageID)
+					break handler
+				}
+				mechanism, ok := auth.Children[0].Value.(string)
 				if !ok {
+					server.logger().Warnf("remote=%s msgID=%d malformed SASL mechanism", conn.RemoteAddr(), messageID)
 					break handler
 				}
-				isSentBindDn = true
+				if mechanism == "" {
+					mechanism = saslMechanism // continuation of a round already in progress
+				}
+				var credentials []byte
+				if len(auth.Children) > 1 {
+					credentials = []byte(auth.Children[1].Data.String())
+				}
+
+				if mechanism != saslMechanism {
+					saslState = nil // a new negotiation starts from a nil state
+				}
+
+				handler, found := server.SASLFns[mechanism]
+				if !found {
+					chanOut <- encodeBindResponseWithSasl(messageID, LDAPResultAuthMethodNotSupported, nil)
+					saslMechanism, saslState = "", nil
+					continue
+				}
+
+				result := handler(server, conn, userState, mechanism, credentials, saslState)
+				if !result.Complete {
+					saslMechanism, saslState = mechanism, result.State
+					chanOut <- encodeBindResponseWithSasl(messageID, LDAPResultSaslBindInProgress, result.ServerCreds)
+					continue
+				}
+
+				saslMechanism, saslState = "", nil
+				if result.Code == LDAPResultSuccess {
+					boundDN = result.BoundDN
+					hasNonAnonymousBind = hasNonAnonymousBind || boundDN != ""
+					isSentBindDn = true
+				}
+				chanOut <- encodeBindResponseWithSasl(messageID, result.Code, result.ServerCreds)
+				if result.Code == LDAPResultSuccess && !maybeProxyBind() {
+					break handler
+				}
+				continue
 			}
-		case ApplicationSearchRequest:
-			if !isSentBindDn {
-				ok = server.sendBindDnRequest(conn, &boundDN)
+
+			saslMechanism, saslState = "", nil // a simple bind ends any SASL negotiation in progress
+			ldapResultCode := HandleBindRequest(req, server.BindFns, conn, userState)
+			if ldapResultCode == LDAPResultSuccess {
+				boundDN, ok = req.Children[1].Value.(string)
 				if !ok {
+					server.logger().Warnf("remote=%s msgID=%d malformed Bind DN", conn.RemoteAddr(), messageID)
 					break handler
 				}
+				hasNonAnonymousBind = hasNonAnonymousBind || boundDN != ""
 				isSentBindDn = true
 			}
+			chanOut <- encodeBindResponse(messageID, ldapResultCode)
 
-			server.Stats.countSearches(1)
-			if err := HandleSearchRequest(req, &controls, messageID, boundDN, server, conn); err != nil {
-				log.Printf("handleSearchRequest error %s", err.Error()) // TODO: make this more testable/better err handling - stop using log, stop using breaks?
-				e := err.(*Error)
-				if err = sendPacket(conn, encodeSearchDone(messageID, e.ResultCode)); err != nil {
-					log.Printf("sendPacket error %s", err.Error())
-					break handler
-				}
+			if ldapResultCode == LDAPResultSuccess && !maybeProxyBind() {
 				break handler
-			} else {
-				if err = sendPacket(conn, encodeSearchDone(messageID, LDAPResultSuccess)); err != nil {
-					log.Printf("sendPacket error %s", err.Error())
-					break handler
-				}
 			}
 		case ApplicationUnbindRequest:
 			server.Stats.countUnbinds(1)
 			break handler // simply disconnect
+		case ApplicationAbandonRequest:
+			targetID, ok := req.Value.(uint64)
+			if ok {
+				requestListMu.Lock()
+				if target, exists := requestList[targetID]; exists {
+					target.Cancel()
+				}
+				requestListMu.Unlock()
+			}
+			HandleAbandonRequest(req, boundDN, server.AbandonFns, conn, userState)
+			// RFC 4511 §4.11: AbandonRequest gets no response. The targeted
+			// worker notices its context was cancelled and exits on its
+			// own; keep serving the rest of this connection.
+
+		case ApplicationSearchRequest:
+			if !isSentBindDn {
+				if shouldProxyBind(server.ProxyBind.Policy, boundDN == "") {
+					clientDN := boundDN
+					ok = server.sendBindDnRequest(conn, chanOut, &boundDN, userState)
+					if !ok {
+						break handler
+					}
+					userState = ProxyState{ClientDN: clientDN, Prior: userState}
+				}
+				isSentBindDn = true
+			}
+
+			boundDNSnapshot := boundDN
+			userStateSnapshot := userState
+			startWorker(messageID, packet, controls, func(ctx context.Context) {
+				server.Stats.countSearches(1)
+				if err := HandleSearchRequest(ctx, req, &controls, messageID, boundDNSnapshot, server, conn, userStateSnapshot); err != nil {
+					server.logger().Errorf("remote=%s msgID=%d handleSearchRequest error: %s", conn.RemoteAddr(), messageID, err.Error()) // TODO: make this more testable/better err handling - stop using breaks?
+					e := err.(*Error)
+					chanOut <- encodeSearchDone(messageID, e.ResultCode)
+					return
+				}
+				chanOut <- encodeSearchDone(messageID, LDAPResultSuccess)
+			})
 		case ApplicationExtendedRequest:
-			ldapResultCode := HandleExtendedRequest(req, boundDN, server.ExtendedFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationExtendedResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
+			if len(req.Children) == 0 {
+				server.logger().Warnf("remote=%s msgID=%d malformed ExtendedRequest: len(req.Children) == 0", conn.RemoteAddr(), messageID)
 				break handler
 			}
-		case ApplicationAbandonRequest:
-			HandleAbandonRequest(req, boundDN, server.AbandonFns, conn)
-			break handler
 
-		case ApplicationAddRequest:
-			ldapResultCode := HandleAddRequest(req, boundDN, server.AddFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationAddResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
-				break handler
+			if oid, ok := req.Children[0].Value.(string); ok && oid == oidStartTLS {
+				ldapResultCode := LDAPResultSuccess
+				switch {
+				case server.TLSConfig == nil:
+					ldapResultCode = LDAPResultUnwillingToPerform
+				case isTLS:
+					ldapResultCode = LDAPResultOperationsError
+				case hasNonAnonymousBind:
+					ldapResultCode = LDAPResultOperationsError
+				}
+
+				// No worker, and critically not even the writer goroutine,
+				// may still be touching conn while we upgrade it: drain
+				// in-flight workers, then close chanOut and wait for the
+				// writer to actually exit so the plaintext success response
+				// below can't land concurrently with a response the writer
+				// was mid-flush on, and so reassigning conn for the
+				// handshake below isn't a data race with the writer's read
+				// of it. A fresh writer bound to the new conn is started
+				// again once we're done with it.
+				workers.Wait()
+				close(chanOut)
+				<-writerDone
+
+				responsePacket := encodeLDAPResponse(messageID, ApplicationExtendedResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
+				if err = sendPacket(conn, responsePacket); err != nil {
+					server.logger().Errorf("remote=%s msgID=%d sendPacket error: %s", conn.RemoteAddr(), messageID, err.Error())
+					// Leave chanOut/writerDone valid (even though unused) so
+					// the teardown code below the loop can close them once.
+					startWriter()
+					break handler
+				}
+				if ldapResultCode != LDAPResultSuccess {
+					startWriter()
+					continue
+				}
+
+				tlsConn := tls.Server(conn, server.TLSConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					server.logger().Errorf("remote=%s msgID=%d StartTLS handshake error: %s", conn.RemoteAddr(), messageID, err.Error())
+					startWriter()
+					break handler
+				}
+				conn = tlsConn
+				isTLS = true
+				userState = TLSState{PeerCertificates: tlsConn.ConnectionState().PeerCertificates, Prior: userState}
+				startWriter()
+				continue
 			}
+
+			boundDNSnapshot := boundDN
+			userStateSnapshot := userState
+			startWorker(messageID, packet, controls, func(ctx context.Context) {
+				ldapResultCode := HandleExtendedRequest(ctx, req, boundDNSnapshot, server.ExtendedFns, conn, userStateSnapshot)
+				chanOut <- encodeLDAPResponse(messageID, ApplicationExtendedResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
+			})
+		case ApplicationAddRequest:
+			boundDNSnapshot := boundDN
+			userStateSnapshot := userState
+			startWorker(messageID, packet, controls, func(ctx context.Context) {
+				ldapResultCode := HandleAddRequest(ctx, req, boundDNSnapshot, server.AddFns, conn, userStateSnapshot)
+				chanOut <- encodeLDAPResponse(messageID, ApplicationAddResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
+			})
 		case ApplicationModifyRequest:
-			ldapResultCode := HandleModifyRequest(req, boundDN, server.ModifyFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationModifyResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			boundDNSnapshot := boundDN
+			userStateSnapshot := userState
+			startWorker(messageID, packet, controls, func(ctx context.Context) {
+				ldapResultCode := HandleModifyRequest(ctx, req, boundDNSnapshot, server.ModifyFns, conn, userStateSnapshot)
+				chanOut <- encodeLDAPResponse(messageID, ApplicationModifyResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
+			})
 		case ApplicationDelRequest:
-			ldapResultCode := HandleDeleteRequest(req, boundDN, server.DeleteFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationDelResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			boundDNSnapshot := boundDN
+			userStateSnapshot := userState
+			startWorker(messageID, packet, controls, func(ctx context.Context) {
+				ldapResultCode := HandleDeleteRequest(ctx, req, boundDNSnapshot, server.DeleteFns, conn, userStateSnapshot)
+				chanOut <- encodeLDAPResponse(messageID, ApplicationDelResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
+			})
 		case ApplicationModifyDNRequest:
-			ldapResultCode := HandleModifyDNRequest(req, boundDN, server.ModifyDNFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationModifyDNResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			boundDNSnapshot := boundDN
+			userStateSnapshot := userState
+			startWorker(messageID, packet, controls, func(ctx context.Context) {
+				ldapResultCode := HandleModifyDNRequest(ctx, req, boundDNSnapshot, server.ModifyDNFns, conn, userStateSnapshot)
+				chanOut <- encodeLDAPResponse(messageID, ApplicationModifyDNResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
+			})
 		case ApplicationCompareRequest:
-			ldapResultCode := HandleCompareRequest(req, boundDN, server.CompareFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationCompareResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			boundDNSnapshot := boundDN
+			userStateSnapshot := userState
+			startWorker(messageID, packet, controls, func(ctx context.Context) {
+				ldapResultCode := HandleCompareRequest(ctx, req, boundDNSnapshot, server.CompareFns, conn, userStateSnapshot)
+				chanOut <- encodeLDAPResponse(messageID, ApplicationCompareResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
+			})
 		}
 	}
 
+	// Drain every in-flight worker before running CloseFns, so a handler
+	// can never still be writing to conn after it's been closed out from
+	// under it.
+	workers.Wait()
+	close(chanOut)
+	<-writerDone
+
 	for _, c := range server.CloseFns {
 		c.Close(boundDN, conn)
 	}
 
-	conn.Close()
-}
-
-func judgeBindDnIsEmpty(p *ber.Packet, result *bool) {
-	class, tagtype, tag := ber.ClassMap[p.ClassType], ber.TypeMap[p.TagType], fmt.Sprintf("0x%02X", p.Tag)
-	if p.ClassType == ber.ClassUniversal {
-		tag = ber.TagMap[p.Tag]
+	if server.OnCloseConnection != nil {
+		server.OnCloseConnection(conn)
 	}
 
-	if class == "Universal" &&
-		tagtype == "Primative" &&
-		tag == "Octet String" &&
-		p.Data.Len() == 0 {
-		*result = true
-	}
-
-	for _, child := range p.Children {
-		judgeBindDnIsEmpty(child, result)
-	}
+	conn.Close()
 }
 
 func makeBindDnRequest(username, password string) *ber.Packet {
@@ -207,28 +411,24 @@ func makeBindDnRequest(username, password string) *ber.Packet {
 	return packet
 }
 
-func (server *Server) sendBindDnRequest(conn net.Conn, boundDN *string) bool {
+func (server *Server) sendBindDnRequest(conn net.Conn, chanOut chan<- *ber.Packet, boundDN *string, userState UserState) bool {
 	var result bool
 
-	bindDnPacket := makeBindDnRequest(ldaplib.BindDn, ldaplib.BindPass)
+	bindDnPacket := makeBindDnRequest(server.ProxyBind.DN, server.ProxyBind.Password)
 	bindDnReq := bindDnPacket.Children[1]
 
 	// ber.PrintPacket(bindDnReq)	// DEBUG
 
 	server.Stats.countBinds(1)
-	ldapResultCode := HandleBindRequest(bindDnReq, server.BindFns, conn)
+	ldapResultCode := HandleBindRequest(bindDnReq, server.BindFns, conn, userState)
 	if ldapResultCode == LDAPResultSuccess {
 		*boundDN, result = bindDnReq.Children[1].Value.(string)
 		if !result {
-			log.Printf("Malformed Bind DN")
+			server.logger().Warnf("remote=%s proxy bind: malformed Bind DN", conn.RemoteAddr())
 		}
 	}
 	messageID := bindDnPacket.Children[0].Value.(uint64)
-	responsePacket := encodeBindResponse(messageID, ldapResultCode)
-	if err := sendPacket(conn, responsePacket); err != nil {
-		log.Printf("sendPacket error %s", err.Error())
-		result = false
-	}
+	chanOut <- encodeBindResponse(messageID, ldapResultCode)
 
 	return result
 }
@@ -0,0 +1,34 @@
+package ldap
+
+import "log"
+
+// Logger lets an application silence or redirect everything the server
+// logs instead of being stuck with package-level log.Printf. Server.Debug
+// gates the per-packet sanity-check traces (malformed packet, messageID or
+// class) behind Debugf. Malformed or unsupported requests go to Warnf and
+// read, write, handshake and search errors go to Errorf, regardless of
+// Debug.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger is the default Logger, backed by the standard library's log
+// package.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { log.Printf("[DEBUG] "+format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { log.Printf("[INFO] "+format, args...) }
+func (stdLogger) Warnf(format string, args ...interface{})  { log.Printf("[WARN] "+format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { log.Printf("[ERROR] "+format, args...) }
+
+// logger returns server.Logger, falling back to stdLogger when the
+// application hasn't set one.
+func (server *Server) logger() Logger {
+	if server.Logger != nil {
+		return server.Logger
+	}
+	return stdLogger{}
+}
@@ -0,0 +1,26 @@
+package ldap
+
+import (
+	"context"
+
+	ber "github.com/nmcclain/asn1-ber"
+)
+
+// Message is a single in-flight LDAP request being processed by a worker
+// goroutine spawned from handleConnectionAndSendBindDn. Ctx/Cancel let an
+// AbandonRequest on the same connection stop the worker early by cancelling
+// the context the handler is running with.
+type Message struct {
+	MessageID uint64
+	Packet    *ber.Packet
+	Controls  []Control
+	Ctx       context.Context
+	Cancel    context.CancelFunc
+}
+
+// UserState is per-connection state passed to the request handlers
+// alongside boundDN, without overloading boundDN's meaning. It starts out
+// nil for every connection; the server itself wraps it in a TLSState after
+// StartTLS and in a ProxyState after a ProxyBind rebind. Server.OnNewConnection
+// only sees the net.Conn and has no way to set it.
+type UserState interface{}
@@ -0,0 +1,49 @@
+package ldap
+
+// ProxyPolicy controls when Server.ProxyBind kicks in.
+type ProxyPolicy int
+
+const (
+	// ProxyNever never rebinds on the client's behalf; the identity
+	// handlers see is exactly what the client presented, including
+	// anonymous. This is the default.
+	ProxyNever ProxyPolicy = iota
+	// ProxyOnAnonymous rebinds as ProxyBind.DN only when the client bound
+	// anonymously (or hasn't bound at all before issuing a search).
+	ProxyOnAnonymous
+	// ProxyAlways rebinds as ProxyBind.DN regardless of what the client
+	// bound as.
+	ProxyAlways
+)
+
+// ProxyBindConfig lets a server transparently rebind connections as a
+// configured admin identity rather than whatever the client presented.
+// Policy defaults to ProxyNever, so library users must opt in explicitly.
+type ProxyBindConfig struct {
+	DN       string
+	Password string
+	Policy   ProxyPolicy
+}
+
+// ProxyState is attached to a connection's UserState whenever ProxyBind
+// rebinds it, so handlers can recover the identity the client actually
+// presented (ClientDN, "" for anonymous) instead of only seeing the
+// server's proxied boundDN. Prior preserves whatever UserState was set
+// before the proxy bind happened.
+type ProxyState struct {
+	ClientDN string
+	Prior    UserState
+}
+
+// shouldProxyBind reports whether ProxyBind should rebind this connection,
+// given whether the client itself is bound anonymously at this point.
+func shouldProxyBind(policy ProxyPolicy, clientIsAnonymous bool) bool {
+	switch policy {
+	case ProxyAlways:
+		return true
+	case ProxyOnAnonymous:
+		return clientIsAnonymous
+	default:
+		return false
+	}
+}
@@ -0,0 +1,27 @@
+package ldap
+
+import "testing"
+
+func TestShouldProxyBind(t *testing.T) {
+	tests := []struct {
+		name              string
+		policy            ProxyPolicy
+		clientIsAnonymous bool
+		want              bool
+	}{
+		{"never, anonymous client", ProxyNever, true, false},
+		{"never, bound client", ProxyNever, false, false},
+		{"on-anonymous, anonymous client", ProxyOnAnonymous, true, true},
+		{"on-anonymous, bound client", ProxyOnAnonymous, false, false},
+		{"always, anonymous client", ProxyAlways, true, true},
+		{"always, bound client", ProxyAlways, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldProxyBind(tt.policy, tt.clientIsAnonymous); got != tt.want {
+				t.Errorf("shouldProxyBind(%v, %v) = %v, want %v", tt.policy, tt.clientIsAnonymous, got, tt.want)
+			}
+		})
+	}
+}
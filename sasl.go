@@ -0,0 +1,69 @@
+package ldap
+
+import (
+	"bytes"
+	"net"
+)
+
+// SASLHandler implements one SASL mechanism registered in Server.SASLFns.
+// It is called once per BindRequest carrying that mechanism's name; state
+// is whatever the handler returned from the previous round (nil on the
+// first round) and lets a multi-round-trip mechanism such as DIGEST-MD5
+// carry a nonce or similar across requests.
+type SASLHandler func(server *Server, conn net.Conn, userState UserState, mechanism string, credentials []byte, state interface{}) SASLResult
+
+// SASLResult is what a SASLHandler returns for one round of a bind.
+// Complete is false while the mechanism needs another round trip, in which
+// case the server answers with LDAPResultSaslBindInProgress and ServerCreds
+// rather than Code. Once Complete is true, Code and (if it's
+// LDAPResultSuccess) BoundDN are used to finish the bind.
+type SASLResult struct {
+	Complete    bool
+	Code        int
+	ServerCreds []byte
+	BoundDN     string
+	State       interface{}
+}
+
+// parsePlainCredentials splits a SASL PLAIN (RFC 4616) credentials blob into
+// its three NUL-separated fields: authzid, authcid, passwd. ok is false if
+// credentials has fewer than two NULs; everything after the second NUL,
+// further NULs included, is returned as passwd.
+func parsePlainCredentials(credentials []byte) (authzid, authcid, passwd string, ok bool) {
+	parts := bytes.SplitN(credentials, []byte{0}, 3)
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return string(parts[0]), string(parts[1]), string(parts[2]), true
+}
+
+// PlainSASLHandler implements the SASL PLAIN mechanism (RFC 4616): it
+// parses "authzid\x00authcid\x00passwd" out of credentials and checks
+// authcid/passwd the same way a simple bind would, via server.BindFns.
+func PlainSASLHandler(server *Server, conn net.Conn, userState UserState, mechanism string, credentials []byte, state interface{}) SASLResult {
+	_, authcid, passwd, ok := parsePlainCredentials(credentials)
+	if !ok {
+		return SASLResult{Complete: true, Code: LDAPResultInvalidCredentials}
+	}
+
+	bindPacket := makeBindDnRequest(authcid, passwd)
+	ldapResultCode := HandleBindRequest(bindPacket.Children[1], server.BindFns, conn, userState)
+
+	boundDN := ""
+	if ldapResultCode == LDAPResultSuccess {
+		boundDN = authcid
+	}
+	return SASLResult{Complete: true, Code: ldapResultCode, BoundDN: boundDN}
+}
+
+// ExternalSASLHandler implements the SASL EXTERNAL mechanism: identity
+// comes from the TLS client certificate StartTLS already stashed in
+// userState (see TLSState), not from credentials, so it requires the
+// connection to have completed StartTLS with a client certificate first.
+func ExternalSASLHandler(server *Server, conn net.Conn, userState UserState, mechanism string, credentials []byte, state interface{}) SASLResult {
+	tlsState, ok := findTLSState(userState)
+	if !ok || len(tlsState.PeerCertificates) == 0 {
+		return SASLResult{Complete: true, Code: LDAPResultInvalidCredentials}
+	}
+	return SASLResult{Complete: true, Code: LDAPResultSuccess, BoundDN: tlsState.PeerCertificates[0].Subject.String()}
+}
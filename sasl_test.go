@@ -0,0 +1,70 @@
+package ldap
+
+import "testing"
+
+func TestParsePlainCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials []byte
+		wantAuthzid string
+		wantAuthcid string
+		wantPasswd  string
+		wantOk      bool
+	}{
+		{
+			name:        "authzid authcid and password",
+			credentials: []byte("admin\x00jdoe\x00secret"),
+			wantAuthzid: "admin",
+			wantAuthcid: "jdoe",
+			wantPasswd:  "secret",
+			wantOk:      true,
+		},
+		{
+			name:        "empty authzid",
+			credentials: []byte("\x00jdoe\x00secret"),
+			wantAuthzid: "",
+			wantAuthcid: "jdoe",
+			wantPasswd:  "secret",
+			wantOk:      true,
+		},
+		{
+			name:        "password containing NUL",
+			credentials: []byte("\x00jdoe\x00se\x00cret"),
+			wantAuthzid: "",
+			wantAuthcid: "jdoe",
+			wantPasswd:  "se\x00cret",
+			wantOk:      true,
+		},
+		{
+			name:        "missing password field",
+			credentials: []byte("\x00jdoe"),
+			wantOk:      false,
+		},
+		{
+			name:        "empty credentials",
+			credentials: []byte(""),
+			wantOk:      false,
+		},
+		{
+			name:        "no separators at all",
+			credentials: []byte("jdoe"),
+			wantOk:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authzid, authcid, passwd, ok := parsePlainCredentials(tt.credentials)
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !tt.wantOk {
+				return
+			}
+			if authzid != tt.wantAuthzid || authcid != tt.wantAuthcid || passwd != tt.wantPasswd {
+				t.Errorf("parsePlainCredentials(%q) = (%q, %q, %q), want (%q, %q, %q)",
+					tt.credentials, authzid, authcid, passwd, tt.wantAuthzid, tt.wantAuthcid, tt.wantPasswd)
+			}
+		})
+	}
+}
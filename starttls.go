@@ -0,0 +1,33 @@
+package ldap
+
+import "crypto/x509"
+
+// oidStartTLS is the LDAPOID RFC 4511 §4.14 reserves for the StartTLS
+// extended operation.
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// TLSState is attached to a connection's UserState once StartTLS has
+// upgraded it, so downstream handlers (notably a SASL EXTERNAL bind) can
+// read the peer's certificate chain without reaching into conn themselves.
+// It wraps the connection's previous UserState, which stays reachable as
+// TLSState.Prior.
+type TLSState struct {
+	PeerCertificates []*x509.Certificate
+	Prior            UserState
+}
+
+// findTLSState walks userState's Prior chain looking for a TLSState,
+// so a later rebind (e.g. ProxyState from ProxyBind) doesn't hide the
+// TLSState a prior StartTLS attached underneath it.
+func findTLSState(userState UserState) (TLSState, bool) {
+	for {
+		switch s := userState.(type) {
+		case TLSState:
+			return s, true
+		case ProxyState:
+			userState = s.Prior
+		default:
+			return TLSState{}, false
+		}
+	}
+}
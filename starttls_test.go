@@ -0,0 +1,28 @@
+package ldap
+
+import "testing"
+
+func TestFindTLSState(t *testing.T) {
+	tls := TLSState{PeerCertificates: nil}
+
+	tests := []struct {
+		name      string
+		userState UserState
+		want      bool
+	}{
+		{"no prior state", nil, false},
+		{"TLSState at top level", tls, true},
+		{"TLSState under one ProxyState", ProxyState{ClientDN: "uid=a", Prior: tls}, true},
+		{"TLSState under nested ProxyState", ProxyState{ClientDN: "uid=a", Prior: ProxyState{ClientDN: "uid=b", Prior: tls}}, true},
+		{"ProxyState with no TLSState underneath", ProxyState{ClientDN: "uid=a", Prior: nil}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := findTLSState(tt.userState)
+			if ok != tt.want {
+				t.Errorf("findTLSState(%#v) ok = %v, want %v", tt.userState, ok, tt.want)
+			}
+		})
+	}
+}